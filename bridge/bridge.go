@@ -0,0 +1,243 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bridge implements a stack.LinkEndpoint that joins a set of member
+// NICs into a single logical L2 broadcast domain, similar to a Linux
+// bridge.
+// bridge包实现了一个stack.LinkEndpoint，它把一组成员网卡合并成一个逻辑上的
+// 二层广播域，类似于Linux网桥。
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brewlin/net-protocol/stack"
+	"github.com/brewlin/net-protocol/tcpip"
+	"github.com/brewlin/net-protocol/tcpip/buffer"
+)
+
+// macTableEntryTTL is how long a learned source-MAC -> member mapping is
+// trusted before it's treated as stale and the bridge falls back to
+// flooding for that destination.
+const macTableEntryTTL = 5 * time.Minute
+
+// macTableEntry is a single MAC learning table record.
+type macTableEntry struct {
+	member *stack.NIC
+	seen   time.Time
+}
+
+// Bridge is a stack.LinkEndpoint joining a set of member NICs into one
+// logical L2 segment. It's meant to be used as the link endpoint of a NIC
+// created through the normal stack NIC-creation path (a "br0"), while its
+// members are separate NICs that had SetBridgePort called on them to
+// redirect their incoming traffic through the bridge instead of their own
+// normal handling.
+// Bridge是一个stack.LinkEndpoint，把一组成员网卡合并成一个逻辑上的二层网段。
+// 它的用法是作为通过常规NIC创建流程新建的一个NIC（类似"br0"）的链路层端，
+// 而它的成员则是另外一些被调用过SetBridgePort、从而把收包重定向到网桥、
+// 而不是走自己正常处理逻辑的NIC。
+type Bridge struct {
+	mu         sync.RWMutex
+	dispatcher stack.NetworkDispatcher
+	members    map[tcpip.NICID]*stack.NIC
+	table      map[tcpip.LinkAddress]macTableEntry
+}
+
+// New creates a Bridge joining the NICs identified by members into one L2
+// segment, resolving each ID against s. IDs that s doesn't recognize are
+// skipped. It returns *Bridge, not just the stack.LinkEndpoint it also
+// implements, so that callers can still reach AddMember/RemoveMember on the
+// value it hands back.
+// New创建一个网桥，把members所标识的网卡合并成一个二层网段，每个ID都通过s
+// 解析；s无法识别的ID会被跳过。返回值是*Bridge而不仅仅是它同时实现的
+// stack.LinkEndpoint，这样调用方才能在拿到的值上继续调用AddMember/
+// RemoveMember。
+func New(s *stack.Stack, members []tcpip.NICID) *Bridge {
+	b := &Bridge{
+		members: make(map[tcpip.NICID]*stack.NIC),
+		table:   make(map[tcpip.LinkAddress]macTableEntry),
+	}
+	for _, id := range members {
+		if nic, ok := s.NICForID(id); ok {
+			b.AddMember(nic)
+		}
+	}
+	return b
+}
+
+// AddMember adds nic to the bridge and redirects its incoming traffic
+// through it.
+// AddMember把nic加入网桥，并把它的收包重定向到网桥。
+func (b *Bridge) AddMember(nic *stack.NIC) {
+	b.mu.Lock()
+	b.members[nic.ID()] = nic
+	b.mu.Unlock()
+	nic.SetBridgePort(b)
+}
+
+// RemoveMember removes nic from the bridge, restoring its normal,
+// non-bridged packet handling.
+func (b *Bridge) RemoveMember(nic *stack.NIC) {
+	b.mu.Lock()
+	delete(b.members, nic.ID())
+	for addr, e := range b.table {
+		if e.member == nic {
+			delete(b.table, addr)
+		}
+	}
+	b.mu.Unlock()
+	nic.ClearBridgePort()
+}
+
+// snapshotMembers returns a snapshot of the bridge's current member NICs.
+// Taking the snapshot under b.mu, rather than iterating live while calling
+// back into a member, avoids any lock-ordering cycle between the bridge and
+// a member NIC's own mutex.
+// snapshotMembers返回网桥当前成员网卡的一份快照。在b.mu下拍摄快照，而不是
+// 一边持锁一边回调成员，避免了网桥与成员网卡自身锁之间可能出现的加锁顺序
+// 死锁。
+func (b *Bridge) snapshotMembers() []*stack.NIC {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	members := make([]*stack.NIC, 0, len(b.members))
+	for _, m := range b.members {
+		members = append(members, m)
+	}
+	return members
+}
+
+// learn records that addr was last seen arriving from member.
+func (b *Bridge) learn(addr tcpip.LinkAddress, member *stack.NIC) {
+	if len(addr) == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.table[addr] = macTableEntry{member: member, seen: time.Now()}
+	b.mu.Unlock()
+}
+
+// lookup returns the member addr was last seen on, if that's still fresh.
+func (b *Bridge) lookup(addr tcpip.LinkAddress) (*stack.NIC, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	e, ok := b.table[addr]
+	if !ok || time.Since(e.seen) > macTableEntryTTL {
+		return nil, false
+	}
+	return e.member, true
+}
+
+// DeliverNetworkPacket implements stack.BridgePort. A member NIC calls this
+// instead of running its own normal packet handling.
+// DeliverNetworkPacket实现了stack.BridgePort接口。成员网卡会调用这个方法，
+// 而不是走自己正常的收包处理逻辑。
+func (b *Bridge) DeliverNetworkPacket(member *stack.NIC, linkEP stack.LinkEndpoint, remoteLinkAddr, localLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	b.learn(remoteLinkAddr, member)
+
+	if dst, ok := b.lookup(localLinkAddr); ok && dst.ID() != member.ID() {
+		// Known unicast destination on another member: forward only there.
+		b.sendTo(dst, remoteLinkAddr, localLinkAddr, protocol, vv)
+		return
+	}
+
+	// Unknown, broadcast, or multicast destination: flood to every other
+	// member, and also deliver up the stack through the bridge's own NIC.
+	for _, m := range b.snapshotMembers() {
+		if m.ID() == member.ID() {
+			continue
+		}
+		b.sendTo(m, remoteLinkAddr, localLinkAddr, protocol, vv)
+	}
+
+	b.mu.RLock()
+	dispatcher := b.dispatcher
+	b.mu.RUnlock()
+	if dispatcher != nil {
+		dispatcher.DeliverNetworkPacket(b, remoteLinkAddr, localLinkAddr, protocol, vv)
+	}
+}
+
+// sendTo writes vv out dst's link layer, preserving the original frame's
+// source/destination link addresses.
+func (b *Bridge) sendTo(dst *stack.NIC, remoteLinkAddr, localLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	r := &stack.Route{RemoteLinkAddress: localLinkAddr, LocalLinkAddress: remoteLinkAddr}
+	dst.LinkEndpoint().WritePacket(r, buffer.NewPrependable(0), vv, protocol)
+}
+
+// Attach implements stack.LinkEndpoint. It's called when the bridge is used
+// as the link endpoint of a NIC, wiring up where packets flooded/forwarded
+// up from members should be delivered.
+func (b *Bridge) Attach(dispatcher stack.NetworkDispatcher) {
+	b.mu.Lock()
+	b.dispatcher = dispatcher
+	b.mu.Unlock()
+}
+
+// IsAttached implements stack.LinkEndpoint.
+func (b *Bridge) IsAttached() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint. It reports the smallest MTU among
+// current members, since that's the largest frame guaranteed to fit out any
+// of them.
+func (b *Bridge) MTU() uint32 {
+	var mtu uint32
+	for _, m := range b.snapshotMembers() {
+		if mmtu := m.LinkEndpoint().MTU(); mtu == 0 || mmtu < mtu {
+			mtu = mmtu
+		}
+	}
+	return mtu
+}
+
+// Capabilities implements stack.LinkEndpoint. The bridge itself performs no
+// checksum offload or address resolution; that's left to its members.
+func (b *Bridge) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.
+func (b *Bridge) MaxHeaderLength() uint16 {
+	return 0
+}
+
+// LinkAddress implements stack.LinkEndpoint. The bridge has no link address
+// of its own; frames sent through it carry the original source address, not
+// the bridge's.
+func (b *Bridge) LinkAddress() tcpip.LinkAddress {
+	return ""
+}
+
+// WritePacket implements stack.LinkEndpoint. It's called when the stack
+// sends a packet out through the bridge's own NIC (e.g. an application
+// bound to the bridge's address); it uses the learning table to pick the
+// right member, flooding when the destination is unknown.
+func (b *Bridge) WritePacket(r *stack.Route, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if dst, ok := b.lookup(r.RemoteLinkAddress); ok {
+		return dst.LinkEndpoint().WritePacket(r, hdr, payload, protocol)
+	}
+
+	var firstErr *tcpip.Error
+	for _, m := range b.snapshotMembers() {
+		if err := m.LinkEndpoint().WritePacket(r, hdr, payload, protocol); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
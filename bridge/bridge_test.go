@@ -0,0 +1,79 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brewlin/net-protocol/stack"
+	"github.com/brewlin/net-protocol/tcpip"
+)
+
+func newTestBridge() *Bridge {
+	return &Bridge{
+		members: make(map[tcpip.NICID]*stack.NIC),
+		table:   make(map[tcpip.LinkAddress]macTableEntry),
+	}
+}
+
+func TestLearnThenLookup(t *testing.T) {
+	b := newTestBridge()
+	member := new(stack.NIC)
+	addr := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+
+	b.learn(addr, member)
+
+	got, ok := b.lookup(addr)
+	if !ok || got != member {
+		t.Fatalf("lookup(%v) = (%v, %v), want (%v, true)", addr, got, ok, member)
+	}
+}
+
+func TestLookupMissesOnUnknownAddress(t *testing.T) {
+	b := newTestBridge()
+	if _, ok := b.lookup("unknown"); ok {
+		t.Fatalf("lookup of never-learned address returned ok = true")
+	}
+}
+
+func TestLookupMissesOnStaleEntry(t *testing.T) {
+	b := newTestBridge()
+	member := new(stack.NIC)
+	addr := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+
+	b.mu.Lock()
+	b.table[addr] = macTableEntry{member: member, seen: time.Now().Add(-macTableEntryTTL - time.Second)}
+	b.mu.Unlock()
+
+	if _, ok := b.lookup(addr); ok {
+		t.Fatalf("lookup of an entry older than macTableEntryTTL returned ok = true")
+	}
+}
+
+func TestLearnOverwritesPreviousMember(t *testing.T) {
+	b := newTestBridge()
+	addr := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x03")
+	first := new(stack.NIC)
+	second := new(stack.NIC)
+
+	b.learn(addr, first)
+	b.learn(addr, second)
+
+	got, ok := b.lookup(addr)
+	if !ok || got != second {
+		t.Fatalf("lookup(%v) = (%v, %v), want (%v, true)", addr, got, ok, second)
+	}
+}
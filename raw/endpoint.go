@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package raw implements the POSIX SOCK_RAW socket type, backed by
+// stack.NIC.AssociateRawEndpoint: endpoints get a copy of every matching
+// network-layer packet, and an endpoint bound to IPProtoRaw can write
+// fully-formed IP datagrams straight past the network layer.
+// raw包实现了POSIX的SOCK_RAW套接字类型，底层依赖
+// stack.NIC.AssociateRawEndpoint：端点会收到每一个匹配的网络层数据包副本，
+// 绑定为IPProtoRaw的端点还可以直接写出构造完整的IP数据报，绕过网络层。
+package raw
+
+import (
+	"sync"
+
+	"github.com/brewlin/net-protocol/stack"
+	"github.com/brewlin/net-protocol/tcpip"
+	"github.com/brewlin/net-protocol/tcpip/buffer"
+)
+
+// IPProtoRaw is the pseudo transport protocol number mirroring the BSD
+// sockets IPPROTO_RAW: an Endpoint associated with it bypasses the stack's
+// network-layer header construction on writes, accepting a fully-formed IP
+// datagram from userspace instead.
+const IPProtoRaw tcpip.TransportProtocolNumber = 255
+
+// EndpointFactory creates raw endpoints. Unlike the transport protocols
+// under tcpip/transport, there is no stack-level registry dispatching
+// socket(2) SOCK_RAW calls to it yet; callers construct an Endpoint directly
+// through NewEndpoint.
+// EndpointFactory用于创建raw端点。和tcpip/transport下的传输层协议不同，
+// 目前还没有stack级别的注册表把用户态的socket(2) SOCK_RAW调用分发给它；
+// 调用方需要直接通过NewEndpoint构造Endpoint。
+type EndpointFactory struct{}
+
+// NewEndpoint creates and associates a new raw endpoint with nic, for
+// netProto/transProto. Pass transProto 0 to receive every packet for
+// netProto regardless of transport protocol.
+func (EndpointFactory) NewEndpoint(nic *stack.NIC, netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber) *Endpoint {
+	ep := &Endpoint{
+		nic:        nic,
+		netProto:   netProto,
+		transProto: transProto,
+	}
+	nic.AssociateRawEndpoint(netProto, ep)
+	return ep
+}
+
+// Endpoint is a raw (SOCK_RAW) endpoint. It queues a copy of every
+// network-layer packet matching its (netProto, transProto) pair for a later
+// Read, and, when transProto is IPProtoRaw, can Write fully-formed IP
+// datagrams straight past the network layer.
+// Endpoint是一个raw套接字端点。它会把每一个匹配(netProto, transProto)组合
+// 的网络层数据包副本排队等待后续Read；当transProto为IPProtoRaw时，还可以
+// 直接Write已经构造完整的IP数据报，绕过网络层。
+type Endpoint struct {
+	nic        *stack.NIC
+	netProto   tcpip.NetworkProtocolNumber
+	transProto tcpip.TransportProtocolNumber
+
+	mu        sync.Mutex
+	rcvList   []buffer.View
+	rcvClosed bool
+}
+
+// TransportProtocol implements stack.RawEndpoint.
+func (e *Endpoint) TransportProtocol() tcpip.TransportProtocolNumber {
+	return e.transProto
+}
+
+// HandlePacket implements stack.RawEndpoint. It is called by the NIC for
+// every network-layer packet matching e's protocol pair.
+func (e *Endpoint) HandlePacket(vv buffer.VectorisedView) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.rcvClosed {
+		return
+	}
+	e.rcvList = append(e.rcvList, vv.ToView())
+}
+
+// Read returns and removes the oldest queued packet, or ErrWouldBlock if
+// none is queued.
+func (e *Endpoint) Read() (buffer.View, *tcpip.Error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.rcvList) == 0 {
+		return buffer.View{}, tcpip.ErrWouldBlock
+	}
+	v := e.rcvList[0]
+	e.rcvList = e.rcvList[1:]
+	return v, nil
+}
+
+// Write sends payload as a fully-formed IP datagram, bypassing the stack's
+// normal network-layer header construction. It is only valid for endpoints
+// bound to IPProtoRaw; anything else must go through a regular transport
+// endpoint instead.
+func (e *Endpoint) Write(payload buffer.View) (uintptr, *tcpip.Error) {
+	if e.transProto != IPProtoRaw {
+		return 0, tcpip.ErrInvalidEndpointState
+	}
+	if err := e.nic.WriteRawPacket(e.netProto, payload.ToVectorisedView()); err != nil {
+		return 0, err
+	}
+	return uintptr(len(payload)), nil
+}
+
+// Close disassociates the endpoint from its NIC and drops any queued
+// packets. It implements the usual repo convention of being safe to call
+// more than once.
+func (e *Endpoint) Close() {
+	e.mu.Lock()
+	if e.rcvClosed {
+		e.mu.Unlock()
+		return
+	}
+	e.rcvClosed = true
+	e.rcvList = nil
+	e.mu.Unlock()
+
+	e.nic.DisassociateRawEndpoint(e.netProto, e)
+}
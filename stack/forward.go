@@ -0,0 +1,268 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/brewlin/net-protocol/tcpip"
+	"github.com/brewlin/net-protocol/tcpip/buffer"
+	"github.com/brewlin/net-protocol/tcpip/header"
+)
+
+// forwardRouteCacheSize bounds the number of (destination -> route)
+// forwarding decisions kept per NIC.
+const forwardRouteCacheSize = 64
+
+// forwardRouteCache is a small per-NIC LRU cache mapping a destination
+// address to a previously resolved outbound Route, so that repeated flows
+// through a busy forwarding NIC skip the full stack.FindRoute route-table
+// walk. Cached routes are released when evicted.
+// forwardRouteCache是挂在单个NIC上的小型LRU缓存，记录目的地址到先前解析出
+// 的出站Route的映射，这样繁忙的转发网卡上重复出现的流就不用每次都走一遍
+// 完整的stack.FindRoute路由表查找。被淘汰的路由会被Release。
+type forwardRouteCache struct {
+	mu    sync.Mutex
+	order *list.List
+	byDst map[tcpip.Address]*list.Element
+}
+
+type forwardRouteCacheEntry struct {
+	dst   tcpip.Address
+	route Route
+}
+
+func newForwardRouteCache() *forwardRouteCache {
+	return &forwardRouteCache{
+		order: list.New(),
+		byDst: make(map[tcpip.Address]*list.Element),
+	}
+}
+
+// get returns the cached route for dst, if any, as an independent reference
+// the caller owns and must Release() once done with it: the returned Route
+// is Clone()'d out of the cache's own copy so a concurrent add() evicting
+// and releasing its slot can never pull the route out from under a caller
+// still using it.
+func (c *forwardRouteCache) get(dst tcpip.Address) (Route, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.byDst[dst]
+	if !ok {
+		return Route{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(forwardRouteCacheEntry).route.Clone(), true
+}
+
+// add caches r for dst. It stores its own Clone() of r, so the cache's
+// reference stays valid independent of whatever the caller (who retains its
+// own reference to r) does with it afterward.
+func (c *forwardRouteCache) add(dst tcpip.Address, r Route) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached := r.Clone()
+	if e, ok := c.byDst[dst]; ok {
+		e.Value.(forwardRouteCacheEntry).route.Release()
+		e.Value = forwardRouteCacheEntry{dst, cached}
+		c.order.MoveToFront(e)
+		return
+	}
+
+	e := c.order.PushFront(forwardRouteCacheEntry{dst, cached})
+	c.byDst[dst] = e
+	if c.order.Len() > forwardRouteCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		entry := oldest.Value.(forwardRouteCacheEntry)
+		delete(c.byDst, entry.dst)
+		entry.route.Release()
+	}
+}
+
+// SetForwarding enables or disables IP forwarding on n specifically. n
+// forwards packets when either this setting or the stack-wide
+// Stack.SetForwarding setting is on.
+// SetForwarding单独开启或关闭n上的IP转发功能。只要这个开关或
+// Stack.SetForwarding全局开关任一开启，n就会转发数据包。
+func (n *NIC) SetForwarding(enable bool) {
+	n.mu.Lock()
+	n.forwarding = enable
+	n.mu.Unlock()
+}
+
+// Forwarding reports whether IP forwarding is enabled on n.
+func (n *NIC) Forwarding() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.forwarding
+}
+
+// forwardPacket is NIC n's path for forwarding a packet it received but
+// that isn't addressed to any of its own endpoints. It: decrements the IPv4
+// TTL/IPv6 hop limit (for IPv4, replying with an ICMP Time Exceeded when it
+// hits zero; an IPv6 packet whose hop limit runs out is dropped with no
+// ICMPv6 reply), honors the IPv4 DF bit by replying with an ICMP
+// Fragmentation Needed when the outbound MTU is too small, and caches the
+// resolved route so repeated flows skip the routing table.
+// forwardPacket是NIC n转发一个收到但非发给自己的数据包的路径。它会：递减
+// IPv4的TTL/IPv6的跳数限制（IPv4减到零时回复ICMP Time Exceeded；IPv6跳数
+// 限制耗尽的包直接丢弃，不回复ICMPv6）、在出站MTU不足时尊重IPv4的DF位回复
+// ICMP Fragmentation Needed、并缓存已解析的路由以便后续同一条流跳过路由表
+// 查找。
+func (n *NIC) forwardPacket(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address, remoteLinkAddr tcpip.LinkAddress, vv buffer.VectorisedView) {
+	n.mu.Lock()
+	if n.fwdRouteCache == nil {
+		n.fwdRouteCache = newForwardRouteCache()
+	}
+	cache := n.fwdRouteCache
+	n.mu.Unlock()
+
+	r, ok := cache.get(dst)
+	if !ok {
+		var err *tcpip.Error
+		r, err = n.stack.FindRoute(0, "", dst, protocol)
+		if err != nil {
+			n.stack.stats.IP.NoRoute.Increment()
+			return
+		}
+		cache.add(dst, r)
+	}
+	// Whether r came from the cache (get() already Clone()'d it for us) or
+	// fresh from FindRoute (add() took its own independent Clone() to
+	// store), this call owns the only reference to this particular copy and
+	// must release it exactly once.
+	defer r.Release()
+
+	r.LocalLinkAddress = n.linkEP.LinkAddress()
+	r.RemoteLinkAddress = remoteLinkAddr
+
+	// outNIC的NUD邻居缓存非nil时，用它重新解析下一跳的链路层地址，而不是沿用
+	// 上面这个来自入站帧的地址（那是发给我们自己的，不是发给下一跳的）。
+	// When outNIC opted into the NUD neighbor cache, re-resolve the next
+	// hop's link address through it instead of keeping the one the inbound
+	// frame arrived with (that's the address that sent the packet to us, not
+	// the one that should receive it next).
+	outNIC := r.ref.nic
+	if outNIC.neigh != nil {
+		if linkRes, ok := n.stack.networkProtocols[protocol].(LinkAddressResolver); ok {
+			nextHop := r.NextHop
+			if nextHop == "" {
+				nextHop = dst
+			}
+			linkAddr, err := outNIC.neigh.entry(nextHop, r.LocalAddress, protocol, linkRes)
+			if err != nil {
+				// Resolution is incomplete (or failed outright); drop this
+				// packet and let the next one retry once it completes.
+				return
+			}
+			r.RemoteLinkAddress = linkAddr
+		}
+	}
+
+	hdr := vv.First()
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(hdr)
+		if ip.TTL() <= 1 {
+			n.stack.stats.IP.TTLExceeded.Increment()
+			n.sendICMPv4Error(r, header.ICMPv4TimeExceeded, header.ICMPv4TTLExceeded, hdr)
+			return
+		}
+		// RFC 1624 incremental checksum update: TTL and Protocol share the
+		// 16-bit word at header offset 8, so decrementing the TTL only
+		// requires folding that one word's old/new values into the existing
+		// checksum, not recomputing it over the whole header.
+		oldTTLWord := uint16(ip.TTL())<<8 | uint16(ip.Protocol())
+		ip.SetTTL(ip.TTL() - 1)
+		newTTLWord := uint16(ip.TTL())<<8 | uint16(ip.Protocol())
+		ip.SetChecksum(incrementalChecksum(ip.Checksum(), oldTTLWord, newTTLWord))
+
+		if ip.Flags()&header.IPv4FlagDontFragment != 0 {
+			if mtu := outNIC.linkEP.MTU(); mtu != 0 && uint32(vv.Size()) > mtu {
+				n.stack.stats.IP.MTUExceeded.Increment()
+				n.sendICMPv4Error(r, header.ICMPv4DstUnreachable, header.ICMPv4FragmentationNeeded, hdr)
+				return
+			}
+		}
+
+	case header.IPv6ProtocolNumber:
+		ip := header.IPv6(hdr)
+		if ip.HopLimit() <= 1 {
+			n.stack.stats.IP.TTLExceeded.Increment()
+			return
+		}
+		ip.SetHopLimit(ip.HopLimit() - 1)
+
+	default:
+		return
+	}
+
+	n.stack.stats.IP.PacketsForwarded.Increment()
+
+	outNIC.mu.RLock()
+	ref, ok := outNIC.endpoints[NetworkEndpointID{dst}]
+	outNIC.mu.RUnlock()
+	if ok && ref.tryIncRef() {
+		// dst happens to be an address owned by the NIC the route points
+		// at (e.g. reached via another interface due to asymmetric
+		// routing); deliver it locally instead of bouncing it back out.
+		ref.ep.HandlePacket(&r, vv)
+		ref.decRef()
+		return
+	}
+
+	outHdr := buffer.NewPrependableFromView(vv.First())
+	vv.RemoveFirst()
+	outNIC.linkEP.WritePacket(&r, outHdr, vv, protocol)
+}
+
+// incrementalChecksum applies the RFC 1624 incremental update to checksum,
+// an existing one's-complement checksum covering a header in which the
+// 16-bit word old has been replaced by new.
+func incrementalChecksum(checksum, oldWord, newWord uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^oldWord) + uint32(newWord)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// sendICMPv4Error replies to the sender of origHdr (an IPv4 header plus at
+// least 8 bytes of payload, per RFC 792) with an ICMPv4 error of the given
+// type/code.
+func (n *NIC) sendICMPv4Error(r Route, icmpType header.ICMPv4Type, code byte, origHdr buffer.View) {
+	payloadLen := len(origHdr)
+	if max := header.IPv4MinimumSize + 8; payloadLen > max {
+		payloadLen = max
+	}
+
+	hdr := buffer.NewPrependable(header.ICMPv4MinimumSize + payloadLen)
+	icmp := header.ICMPv4(hdr.Prepend(header.ICMPv4MinimumSize + payloadLen))
+	icmp.SetType(icmpType)
+	icmp.SetCode(code)
+	copy(icmp.Payload(), origHdr[:payloadLen])
+	icmp.SetChecksum(0)
+	icmp.SetChecksum(^header.Checksum(icmp, 0))
+
+	replyRoute, err := n.stack.FindRoute(0, "", header.IPv4(origHdr).SourceAddress(), header.IPv4ProtocolNumber)
+	if err != nil {
+		return
+	}
+	defer replyRoute.Release()
+
+	replyRoute.WritePacket(buffer.NewPrependable(0), buffer.NewVectorisedView(len(icmp), []buffer.View{buffer.View(icmp)}), header.ICMPv4ProtocolNumber)
+}
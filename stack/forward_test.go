@@ -0,0 +1,48 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"testing"
+
+	"github.com/brewlin/net-protocol/tcpip/header"
+)
+
+func TestIncrementalChecksumMatchesFullRecompute(t *testing.T) {
+	hdr := header.IPv4(make([]byte, header.IPv4MinimumSize))
+	hdr.SetTTL(64)
+	hdr.SetProtocol(6)
+	hdr.SetChecksum(0)
+	hdr.SetChecksum(^header.Checksum(hdr[:hdr.HeaderLength()], 0))
+
+	oldWord := uint16(hdr.TTL())<<8 | uint16(hdr.Protocol())
+	hdr.SetTTL(hdr.TTL() - 1)
+	newWord := uint16(hdr.TTL())<<8 | uint16(hdr.Protocol())
+	got := incrementalChecksum(hdr.Checksum(), oldWord, newWord)
+
+	hdr.SetChecksum(0)
+	want := ^header.Checksum(hdr[:hdr.HeaderLength()], 0)
+
+	if got != want {
+		t.Fatalf("incrementalChecksum = %#x, want %#x (full recompute)", got, want)
+	}
+}
+
+func TestIncrementalChecksumNoOpForUnchangedWord(t *testing.T) {
+	const word = uint16(0x4006)
+	if got := incrementalChecksum(0xbeef, word, word); got != 0xbeef {
+		t.Fatalf("incrementalChecksum with old == new = %#x, want unchanged 0xbeef", got)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brewlin/net-protocol/tcpip"
+)
+
+// neighborEntry is a single record in a neighborCache, corresponding to the
+// Neighbor Cache Entry of RFC 4861.
+// neighborEntry是neighborCache中的一条记录，对应RFC 4861中的Neighbor Cache
+// Entry。
+type neighborEntry struct {
+	mu sync.Mutex
+
+	addr     tcpip.Address
+	linkAddr tcpip.LinkAddress
+	state    NeighborState
+	probes   uint32
+	timer    *time.Timer
+}
+
+// neighborCache is a per-NIC cache implementing the RFC 4861 Neighbor
+// Unreachability Detection state machine. A NIC gets one when
+// NIC.setNUDConfigurations is first called on it; there is no option for it
+// at NIC creation. It is consulted only when forwardPacket sends a forwarded
+// packet out the NIC; the NIC's own outgoing routes still resolve link
+// addresses through the stack-wide linkAddrCache.
+// neighborCache是挂在单个NIC上的缓存，实现RFC 4861的Neighbor Unreachability
+// Detection状态机。首次对某个NIC调用NIC.setNUDConfigurations时为它创建，创建
+// NIC时没有对应的选项。只有forwardPacket把转发的包从该NIC发出时才会查询它；
+// 该NIC自身的出站路由仍然通过stack级别的linkAddrCache解析链路层地址。
+type neighborCache struct {
+	nic *NIC
+
+	mu      sync.Mutex
+	config  NUDConfigurations
+	entries map[tcpip.Address]*neighborEntry
+}
+
+// newNeighborCache creates an empty neighborCache for nic, using the default
+// NUD configurations.
+func newNeighborCache(nic *NIC) *neighborCache {
+	return &neighborCache{
+		nic:     nic,
+		config:  DefaultNUDConfigurations(),
+		entries: make(map[tcpip.Address]*neighborEntry),
+	}
+}
+
+// setConfig replaces the NUD configurations. Every state transition started
+// after this call, on new and existing entries alike, uses the new values;
+// a timer chain already running (e.g. an Incomplete entry's retransmissions)
+// keeps the values it was started with.
+func (c *neighborCache) setConfig(config NUDConfigurations) {
+	c.mu.Lock()
+	c.config = config
+	c.mu.Unlock()
+}
+
+// neighbors returns a snapshot of every entry currently in the cache, for
+// introspection (e.g. "ip neigh show").
+// neighbors返回当前缓存中所有记录的快照，用于内省（类似"ip neigh show"）。
+func (c *neighborCache) neighbors() []NeighborEntryInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	infos := make([]NeighborEntryInfo, 0, len(c.entries))
+	for _, e := range c.entries {
+		e.mu.Lock()
+		infos = append(infos, NeighborEntryInfo{
+			Addr:     e.addr,
+			LinkAddr: e.linkAddr,
+			State:    e.state,
+		})
+		e.mu.Unlock()
+	}
+	return infos
+}
+
+// NeighborEntryInfo is a point-in-time, read-only view of a neighborEntry.
+type NeighborEntryInfo struct {
+	Addr     tcpip.Address
+	LinkAddr tcpip.LinkAddress
+	State    NeighborState
+}
+
+// entry returns the link address for addr, kicking off resolution (moving a
+// fresh entry to Incomplete and sending solicitations) if it isn't already
+// known. Callers that get ErrWouldBlock are expected to retry once
+// resolution completes, mirroring the contract of linkAddrCache.get.
+// entry返回addr对应的链路层地址，如果尚未知道则触发解析（新建一个处于
+// Incomplete状态的记录并发送请求报文）。调用者收到ErrWouldBlock时，应当在
+// 地址解析完成后重试，这与linkAddrCache.get的约定一致。
+func (c *neighborCache) entry(addr, localAddr tcpip.Address, protocol tcpip.NetworkProtocolNumber, linkRes LinkAddressResolver) (tcpip.LinkAddress, *tcpip.Error) {
+	c.mu.Lock()
+	e, ok := c.entries[addr]
+	if !ok {
+		e = &neighborEntry{addr: addr, state: Incomplete}
+		c.entries[addr] = e
+	}
+	// Snapshot config under c.mu rather than letting the locked-entry
+	// methods below read c.config directly: they run after c.mu is
+	// released (and some re-arm themselves from their own timers well
+	// after that), so a live *neighborCache read would race with a
+	// concurrent setConfig.
+	// 在c.mu下拍摄config的快照，而不是让下面这些持有entry锁的方法直接读取
+	// c.config：它们在c.mu释放之后才运行（其中一些还会在自己的定时器里,
+	// 在那之后很久重新武装自己），如果直接读取活的*neighborCache会和并发的
+	// setConfig产生竞争。
+	config := c.config
+	c.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch e.state {
+	case Reachable, Stale, Delay, Probe, Static:
+		if e.state == Stale {
+			e.enterDelayLocked(c, config, localAddr, protocol, linkRes)
+		}
+		return e.linkAddr, nil
+	case Unreachable:
+		c.nic.stack.stats.Neighbor.UnreachableEntryLookups.Increment()
+		return "", tcpip.ErrNoLinkAddress
+	case Incomplete:
+		if e.probes == 0 {
+			e.enterIncompleteLocked(c, config, localAddr, protocol, linkRes)
+		}
+		return "", tcpip.ErrWouldBlock
+	default:
+		return "", tcpip.ErrWouldBlock
+	}
+}
+
+// handleConfirmation updates the entry for addr in response to a solicited
+// neighbor advertisement (or equivalent), moving it to Reachable and
+// recording linkAddr.
+func (c *neighborCache) handleConfirmation(addr tcpip.Address, linkAddr tcpip.LinkAddress) {
+	c.mu.Lock()
+	e, ok := c.entries[addr]
+	config := c.config
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.linkAddr = linkAddr
+	e.probes = 0
+	e.enterReachableLocked(config)
+}
+
+// handleUpperLevelConfirmation records that upper-layer forward progress
+// (e.g. an ACK for new data) proves addr is still reachable, without needing
+// a fresh NUD probe. Per RFC 4861 section 7.3.1, this only ever moves an
+// entry towards Reachable; it never creates one. Its only caller is
+// NIC.handleUpperLevelConfirmation, which nothing in the stack calls.
+// handleUpperLevelConfirmation记录上层的前向进展（例如新数据的ACK）证明addr
+// 仍然可达，从而不需要重新发起一次NUD探测。按照RFC 4861 7.3.1节，这只会把
+// 已有记录推向Reachable，不会凭空创建新记录。它唯一的调用方是
+// NIC.handleUpperLevelConfirmation，而协议栈中没有任何代码调用后者。
+func (c *neighborCache) handleUpperLevelConfirmation(addr tcpip.Address) {
+	c.mu.Lock()
+	e, ok := c.entries[addr]
+	config := c.config
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch e.state {
+	case Reachable, Stale, Delay, Probe:
+		e.enterReachableLocked(config)
+	}
+}
+
+// enterIncompleteLocked starts address resolution: it sends up to
+// MaxMulticastProbes multicast solicitations, spaced RetransmitTimer apart,
+// and moves to Unreachable if none are answered. e.mu must be held. config
+// must be a snapshot taken under c.mu, not read live off c, since this and
+// everything it schedules runs without c.mu held.
+func (e *neighborEntry) enterIncompleteLocked(c *neighborCache, config NUDConfigurations, localAddr tcpip.Address, protocol tcpip.NetworkProtocolNumber, linkRes LinkAddressResolver) {
+	e.state = Incomplete
+	e.probes = 1
+	linkRes.LinkAddressRequest(e.addr, localAddr, c.nic.linkEP)
+	e.rearmLocked(config.RetransmitTimer, func() { e.retryIncompleteLocked(c, config, localAddr, protocol, linkRes) })
+}
+
+// retryIncompleteLocked re-runs the Incomplete retransmission/timeout check;
+// it's split out from enterIncompleteLocked so the timer can keep calling it
+// without re-sending the very first solicitation.
+func (e *neighborEntry) retryIncompleteLocked(c *neighborCache, config NUDConfigurations, localAddr tcpip.Address, protocol tcpip.NetworkProtocolNumber, linkRes LinkAddressResolver) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state != Incomplete {
+		return
+	}
+	if e.probes >= config.MaxMulticastProbes {
+		e.state = Unreachable
+		e.scheduleRemovalLocked(c, config)
+		return
+	}
+	e.probes++
+	linkRes.LinkAddressRequest(e.addr, localAddr, c.nic.linkEP)
+	e.rearmLocked(config.RetransmitTimer, func() { e.retryIncompleteLocked(c, config, localAddr, protocol, linkRes) })
+}
+
+// enterReachableLocked moves the entry to Reachable for a randomized
+// ReachableTime, after which it falls back to Stale. e.mu must be held.
+func (e *neighborEntry) enterReachableLocked(config NUDConfigurations) {
+	e.state = Reachable
+	e.rearmLocked(config.reachableTime(), func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.state == Reachable {
+			e.state = Stale
+		}
+	})
+}
+
+// enterDelayLocked is entered the first time a packet is sent through a
+// Stale entry: it waits DelayFirstProbeTime for an upper-layer confirmation
+// before falling through to Probe. e.mu must be held. config must be a
+// snapshot taken under c.mu, not read live off c.
+func (e *neighborEntry) enterDelayLocked(c *neighborCache, config NUDConfigurations, localAddr tcpip.Address, protocol tcpip.NetworkProtocolNumber, linkRes LinkAddressResolver) {
+	e.state = Delay
+	e.probes = 0
+	e.rearmLocked(config.DelayFirstProbeTime, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.state == Delay {
+			e.enterProbeLocked(c, config, localAddr, protocol, linkRes)
+		}
+	})
+}
+
+// enterProbeLocked sends up to MaxUnicastProbes unicast solicitations,
+// spaced RetransmitTimer apart, moving to Unreachable if none are answered.
+// e.mu must be held. config must be a snapshot taken under c.mu, not read
+// live off c.
+func (e *neighborEntry) enterProbeLocked(c *neighborCache, config NUDConfigurations, localAddr tcpip.Address, protocol tcpip.NetworkProtocolNumber, linkRes LinkAddressResolver) {
+	e.state = Probe
+	e.probes = 1
+	linkRes.LinkAddressRequest(e.addr, localAddr, c.nic.linkEP)
+	e.rearmLocked(config.RetransmitTimer, func() { e.retryProbeLocked(c, config, localAddr, protocol, linkRes) })
+}
+
+func (e *neighborEntry) retryProbeLocked(c *neighborCache, config NUDConfigurations, localAddr tcpip.Address, protocol tcpip.NetworkProtocolNumber, linkRes LinkAddressResolver) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state != Probe {
+		return
+	}
+	if e.probes >= config.MaxUnicastProbes {
+		e.state = Unreachable
+		e.scheduleRemovalLocked(c, config)
+		return
+	}
+	e.probes++
+	linkRes.LinkAddressRequest(e.addr, localAddr, c.nic.linkEP)
+	e.rearmLocked(config.RetransmitTimer, func() { e.retryProbeLocked(c, config, localAddr, protocol, linkRes) })
+}
+
+// scheduleRemovalLocked removes the entry from its cache after
+// UnreachableTime. e.mu must be held. config must be a snapshot taken under
+// c.mu, not read live off c.
+func (e *neighborEntry) scheduleRemovalLocked(c *neighborCache, config NUDConfigurations) {
+	e.rearmLocked(config.UnreachableTime, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.entries[e.addr] == e {
+			delete(c.entries, e.addr)
+		}
+	})
+}
+
+// rearmLocked stops any pending timer on the entry and starts a new one.
+// e.mu must be held; fn runs without the lock held.
+func (e *neighborEntry) rearmLocked(d time.Duration, fn func()) {
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.timer = time.AfterFunc(d, fn)
+}
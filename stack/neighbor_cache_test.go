@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brewlin/net-protocol/tcpip"
+)
+
+func TestNeighborEntryReachableFallsBackToStale(t *testing.T) {
+	config := NUDConfigurations{
+		BaseReachableTime: 10 * time.Millisecond,
+		MinRandomFactor:   1,
+		MaxRandomFactor:   1,
+	}
+
+	e := &neighborEntry{addr: tcpip.Address("\x01\x02\x03\x04")}
+	e.mu.Lock()
+	e.enterReachableLocked(config)
+	state := e.state
+	e.mu.Unlock()
+
+	if state != Reachable {
+		t.Fatalf("got state = %s, want Reachable", state)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		e.mu.Lock()
+		state = e.state
+		e.mu.Unlock()
+		if state == Stale {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("entry never fell back to Stale after BaseReachableTime elapsed, got state = %s", state)
+}
+
+func TestNeighborEntryScheduleRemoval(t *testing.T) {
+	addr := tcpip.Address("\x01\x02\x03\x04")
+	config := NUDConfigurations{UnreachableTime: 10 * time.Millisecond}
+
+	e := &neighborEntry{addr: addr, state: Unreachable}
+	c := &neighborCache{
+		config:  config,
+		entries: map[tcpip.Address]*neighborEntry{addr: e},
+	}
+
+	e.mu.Lock()
+	e.scheduleRemovalLocked(c, config)
+	e.mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		_, ok := c.entries[addr]
+		c.mu.Unlock()
+		if !ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("entry was never removed from the cache after UnreachableTime elapsed")
+}
+
+func TestNUDConfigurationsReachableTime(t *testing.T) {
+	config := NUDConfigurations{
+		BaseReachableTime: 100 * time.Millisecond,
+		MinRandomFactor:   0.5,
+		MaxRandomFactor:   1.5,
+	}
+
+	for i := 0; i < 100; i++ {
+		d := config.reachableTime()
+		if d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("reachableTime() = %s, want within [50ms, 150ms]", d)
+		}
+	}
+}
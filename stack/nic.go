@@ -49,8 +49,110 @@ type NIC struct {
 	endpoints map[NetworkEndpointID]*referencedNetworkEndpoint
 	// 子网的记录
 	subnets []tcpip.Subnet
+
+	// neigh is non-nil when this NIC was opted into the RFC 4861 NUD-based
+	// neighbor cache (see setNUDConfigurations). It is used for forwarded
+	// packets only; the NIC's own routes still use the stack-wide
+	// linkAddrCache. Protected by mu.
+	// neigh非nil表示该NIC启用了基于RFC 4861 NUD的邻居缓存（见
+	// setNUDConfigurations）。它只用于转发的数据包；该NIC自身的路由仍使用
+	// stack级别的linkAddrCache。由mu保护。
+	neigh *neighborCache
+
+	// rawEndpoints记录了该NIC上注册的raw套接字端点，按(网络层协议,传输层
+	// 协议)分桶，参见raw.go。由mu保护。
+	// rawEndpoints holds the raw (SOCK_RAW) endpoints associated with this
+	// NIC, bucketed by (network protocol, transport protocol); see raw.go.
+	// Protected by mu.
+	rawEndpoints map[rawEndpointKey][]RawEndpoint
+
+	// forwarding是该NIC自己的转发开关，与stack级别的Stack.Forwarding()
+	// 相互独立，见forward.go。由mu保护。
+	// forwarding is this NIC's own forwarding switch, independent of the
+	// stack-wide Stack.Forwarding(); see forward.go. Protected by mu.
+	forwarding bool
+
+	// fwdRouteCache缓存了forwardPacket解析出的(目的地址->路由)，懒创建，
+	// 由mu保护其初始化，此后自身带锁。
+	// fwdRouteCache caches forwardPacket's resolved (destination -> route)
+	// decisions. Lazily created; mu guards its creation, it locks itself
+	// thereafter.
+	fwdRouteCache *forwardRouteCache
+
+	// bridgePort非nil时，表示该NIC是某个bridge的成员，此时它收到的数据包
+	// 交给bridgePort处理，而不是走NIC自己的正常逻辑，参见SetBridgePort。
+	// bridgePort, when non-nil, means this NIC is a member of a bridge: its
+	// incoming packets are handed to bridgePort instead of going through
+	// the NIC's own normal handling. See SetBridgePort.
+	bridgePort BridgePort
+}
+
+// BridgePort is implemented by a bridge (see the bridge package) that a
+// member NIC's incoming packets are redirected to, in place of the NIC's
+// own normal DeliverNetworkPacket handling. It's defined here, rather than
+// in the bridge package, so NIC can hold a reference to one without this
+// package having to import bridge (which itself needs to import stack).
+// BridgePort由一个网桥（见bridge包）实现，成员网卡收到的数据包会被重定向
+// 给它，而不是走网卡自身正常的DeliverNetworkPacket逻辑。之所以定义在这里
+// 而不是bridge包里，是为了让NIC能持有对它的引用，又不需要本包反过来导入
+// bridge包（bridge包本身需要导入stack包）。
+type BridgePort interface {
+	DeliverNetworkPacket(member *NIC, linkEP LinkEndpoint, remoteLinkAddr, localLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView)
+}
+
+// SetBridgePort marks n as a member of a bridge, redirecting its future
+// incoming packets to port instead of n's own normal handling.
+func (n *NIC) SetBridgePort(port BridgePort) {
+	n.mu.Lock()
+	n.bridgePort = port
+	n.mu.Unlock()
 }
 
+// ClearBridgePort undoes a prior SetBridgePort, restoring n's normal
+// incoming packet handling.
+func (n *NIC) ClearBridgePort() {
+	n.mu.Lock()
+	n.bridgePort = nil
+	n.mu.Unlock()
+}
+
+// LinkEndpoint returns n's underlying link endpoint. Exists so that code
+// outside this package (e.g. the bridge package) that needs to write
+// frames directly to a specific NIC's link layer doesn't need its own copy
+// of it.
+func (n *NIC) LinkEndpoint() LinkEndpoint {
+	return n.linkEP
+}
+
+// endpointKind describes the lifecycle state of a referencedNetworkEndpoint.
+// endpointKind 描述了一个网络层端引用的生命周期状态
+type endpointKind int32
+
+const (
+	// permanent表示该端点是通过AddAddress显式添加的，在RemoveAddress之前
+	// 一直有效。
+	// permanentEndpoint is a permanent endpoint that was explicitly added via
+	// AddAddress and remains valid until RemoveAddress is called on it.
+	permanentEndpoint endpointKind = iota
+
+	// permanentExpired表示该端点曾经是permanent，但已经被RemoveAddress移除；
+	// 只要还有路由引用它，它就继续存活，但不再接受/发送数据包（除非网卡处于
+	// 混杂/伪装模式，或该地址落在网卡配置的某个子网内）。
+	// permanentExpiredEndpoint is a permanent endpoint that has been removed
+	// via RemoveAddress, but remains alive because routes still hold
+	// references to it. It cannot be used to deliver incoming packets or
+	// create new outgoing routes (unless the NIC is promiscuous/spoofing, or
+	// the address falls within one of the NIC's configured subnets).
+	permanentExpiredEndpoint
+
+	// temporary表示该端点是为了满足混杂模式或地址伪装而临时创建的，只要
+	// 还有路由引用它就存活，没有引用后立即被清理。
+	// temporaryEndpoint is an endpoint created to accommodate promiscuous
+	// mode or spoofing and lives only as long as a route holds a reference
+	// to it.
+	temporaryEndpoint
+)
+
 // PrimaryEndpointBehavior is an enumeration of an endpoint's primacy behavior.
 type PrimaryEndpointBehavior int
 
@@ -113,6 +215,55 @@ func (n *NIC) setSpoofing(enable bool) {
 	n.mu.Unlock()
 }
 
+// setNUDConfigurations opts n into the RFC 4861 NUD-based neighbor cache
+// (creating it on first use) and applies c to it. The cache resolves next
+// hops only for packets forwardPacket sends out n; routes created on n keep
+// resolving through the stack-wide linkAddrCache.
+// setNUDConfigurations 让n启用基于RFC 4861 NUD的邻居缓存（首次调用时创建），
+// 并应用c中的参数。该缓存只为forwardPacket从n发出的数据包解析下一跳；在n上
+// 创建的路由仍通过stack级别的linkAddrCache解析。
+func (n *NIC) setNUDConfigurations(c NUDConfigurations) {
+	n.mu.Lock()
+	if n.neigh == nil {
+		n.neigh = newNeighborCache(n)
+	}
+	n.neigh.setConfig(c)
+	n.mu.Unlock()
+}
+
+// neighbors returns a snapshot of n's neighbor cache entries. It returns
+// false if n is not using the neighbor cache (i.e. setNUDConfigurations was
+// never called).
+// neighbors返回n的邻居缓存记录快照，如果n并未启用邻居缓存（即从未调用过
+// setNUDConfigurations），则返回false。
+func (n *NIC) neighbors() ([]NeighborEntryInfo, bool) {
+	n.mu.RLock()
+	neigh := n.neigh
+	n.mu.RUnlock()
+	if neigh == nil {
+		return nil, false
+	}
+	return neigh.neighbors(), true
+}
+
+// handleUpperLevelConfirmation moves n's neighbor entry for addr to
+// Reachable, as forward progress against addr (e.g. an ACK for new data)
+// proves it's still reachable. Nothing in the stack calls it, so TCP
+// acknowledgements do not refresh neighbor entries. It is a no-op if n isn't
+// using the neighbor cache.
+// handleUpperLevelConfirmation把n上addr对应的邻居记录推向Reachable，依据是
+// 针对addr的前向进展（例如收到新数据的ACK）证明其仍然可达。协议栈中没有
+// 任何代码调用它，因此TCP的确认不会刷新邻居记录。如果n未启用邻居缓存，则为
+// 空操作。
+func (n *NIC) handleUpperLevelConfirmation(addr tcpip.Address) {
+	n.mu.RLock()
+	neigh := n.neigh
+	n.mu.RUnlock()
+	if neigh != nil {
+		neigh.handleUpperLevelConfirmation(addr)
+	}
+}
+
 func (n *NIC) getMainNICAddress(protocol tcpip.NetworkProtocolNumber) (tcpip.Address, tcpip.Subnet, *tcpip.Error) {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
@@ -123,7 +274,7 @@ func (n *NIC) getMainNICAddress(protocol tcpip.NetworkProtocolNumber) (tcpip.Add
 	if list, ok := n.primary[protocol]; ok {
 		for e := list.Front(); e != nil; e = e.Next() {
 			ref := e.(*referencedNetworkEndpoint)
-			if ref.holdsInsertRef && ref.tryIncRef() {
+			if ref.kind == permanentEndpoint && ref.tryIncRef() {
 				r = ref
 				break
 			}
@@ -134,7 +285,7 @@ func (n *NIC) getMainNICAddress(protocol tcpip.NetworkProtocolNumber) (tcpip.Add
 	// If no primary endpoints then check for other endpoints.
 	if r == nil {
 		for _, ref := range n.endpoints {
-			if ref.holdsInsertRef && ref.tryIncRef() {
+			if ref.kind == permanentEndpoint && ref.tryIncRef() {
 				r = ref
 				break
 			}
@@ -173,6 +324,9 @@ func (n *NIC) primaryEndpoint(protocol tcpip.NetworkProtocolNumber) *referencedN
 
 	for e := list.Front(); e != nil; e = e.Next() {
 		r := e.(*referencedNetworkEndpoint)
+		if r.kind == permanentExpiredEndpoint {
+			continue
+		}
 		// TODO: allow broadcast address when SO_BROADCAST is set.
 		switch r.ep.ID().LocalAddress {
 		case header.IPv4Broadcast, header.IPv4Any:
@@ -186,37 +340,21 @@ func (n *NIC) primaryEndpoint(protocol tcpip.NetworkProtocolNumber) *referencedN
 	return nil
 }
 
-// findEndpoint finds the endpoint, if any, with the given address.
-// 根据address参数查找对应的网络层端
+// findEndpoint finds the endpoint, if any, with the given address. It
+// returns ErrInvalidEndpointState if address names an endpoint that's been
+// removed (RemoveAddress) but is still alive because a route holds a
+// reference to it, and spoofing isn't enabled to allow sending through it
+// anyway.
+// 根据address参数查找对应的网络层端。如果address对应的端点已经被移除
+// （RemoveAddress）但因为还有路由引用着它而仍然存活，且没有开启地址伪装
+// 允许继续通过它发送，则返回ErrInvalidEndpointState。
 func (n *NIC) findEndpoint(protocol tcpip.NetworkProtocolNumber, address tcpip.Address,
-	peb PrimaryEndpointBehavior) *referencedNetworkEndpoint {
-	id := NetworkEndpointID{address}
-
+	peb PrimaryEndpointBehavior) (*referencedNetworkEndpoint, *tcpip.Error) {
 	n.mu.RLock()
-	ref := n.endpoints[id]
-	if ref != nil && !ref.tryIncRef() {
-		ref = nil
-	}
-	spoofing := n.spoofing
+	allowTemp := n.spoofing || n.subnetMatchesLocked(address)
 	n.mu.RUnlock()
 
-	if ref != nil || !spoofing {
-		return ref
-	}
-
-	// Try again with the lock in exclusive mode. If we still can't get the
-	// endpoint, create a new "temporary" endpoint. It will only exist while
-	// there's a route through it.
-	n.mu.Lock()
-	ref = n.endpoints[id]
-	if ref == nil || !ref.tryIncRef() {
-		ref, _ = n.addAddressLocked(protocol, address, peb, true)
-		if ref != nil {
-			ref.holdsInsertRef = false
-		}
-	}
-	n.mu.Unlock()
-	return ref
+	return n.getRefOrCreateTemp(protocol, address, peb, allowTemp)
 }
 
 // 在NIC上添加addr地址，注册和初始化网络层协议
@@ -230,16 +368,40 @@ func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.
 		return nil, tcpip.ErrUnknownProtocol
 	}
 
-	// Create the new network endpoint.
-	// 比如netProto为ipv4，会调用ipv4.NewEndpoint，新建一个网络层端
-	ep, err := netProto.NewEndpoint(n.id, addr, n.stack, n, n.linkEP)
-	if err != nil {
-		return nil, err
-	}
-
-	// 获取网络层端的id，其实就是ip地址
-	id := *ep.ID()
+	// 网络端的id其实就是ip地址本身，不依赖NewEndpoint的结果，因此可以在构造
+	// 新端点之前先查一遍，判断是否走下面的复活分支。
+	// The endpoint's id is just the address itself, so it doesn't depend on
+	// the result of NewEndpoint; look it up before constructing a new
+	// endpoint so the revive case below doesn't have to discard one.
+	id := NetworkEndpointID{addr}
 	if ref, ok := n.endpoints[id]; ok {
+		// Re-adding a permanent address that was previously removed revives
+		// the existing (possibly still-referenced-by-routes) endpoint
+		// in place, instead of tearing it down and creating a new one.
+		// This only applies to explicit AddAddress calls (replace == false);
+		// callers creating promiscuous/spoofing temporary endpoints always
+		// go through the replace path below.
+		// 重新添加一个已过期的permanent地址时，直接原地复活该端点，保留现有
+		// 的路由引用，而不是销毁后重建。该复活逻辑只适用于显式的AddAddress
+		// 调用（replace == false），混杂模式/伪装场景下创建临时端点时总是
+		// 走下面的替换逻辑。
+		if ref.kind == permanentExpiredEndpoint && !replace {
+			// RemoveAddress decRef'd away the permanent registration's own
+			// anchor reference when it expired the endpoint (keeping only
+			// whatever routes still held one); restore that anchor now that
+			// it's permanent again, otherwise the last route to let go will
+			// drop the count to zero while kind == permanentEndpoint and
+			// removeEndpointLocked will panic.
+			// RemoveAddress在使端点过期时，已经decRef掉了permanent注册自身
+			// 持有的那一份锚定引用（只留下路由可能持有的引用）；现在它重新
+			// 变回permanent，需要把这份锚定引用补回来，否则最后一个路由释放
+			// 引用时，计数会在kind == permanentEndpoint的情况下归零，
+			// removeEndpointLocked就会panic。
+			ref.incRef()
+			ref.kind = permanentEndpoint
+			return ref, nil
+		}
+
 		// 不是替换，且该id否存在，返回错误
 		if !replace {
 			return nil, tcpip.ErrDuplicateAddress
@@ -248,12 +410,19 @@ func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.
 		n.removeEndpointLocked(ref)
 	}
 
+	// Create the new network endpoint.
+	// 比如netProto为ipv4，会调用ipv4.NewEndpoint，新建一个网络层端
+	ep, err := netProto.NewEndpoint(n.id, addr, n.stack, n, n.linkEP)
+	if err != nil {
+		return nil, err
+	}
+
 	ref := &referencedNetworkEndpoint{
-		refs:           1,
-		ep:             ep,
-		nic:            n,
-		protocol:       protocol,
-		holdsInsertRef: true,
+		refs:     1,
+		ep:       ep,
+		nic:      n,
+		protocol: protocol,
+		kind:     permanentEndpoint,
 	}
 
 	// Set up cache if link address resolution exists for this protocol.
@@ -383,7 +552,7 @@ func (n *NIC) removeEndpointLocked(r *referencedNetworkEndpoint) {
 		return
 	}
 
-	if r.holdsInsertRef {
+	if r.kind == permanentEndpoint {
 		panic("Reference count dropped to zero before being removed")
 	}
 
@@ -406,12 +575,19 @@ func (n *NIC) removeEndpoint(r *referencedNetworkEndpoint) {
 func (n *NIC) RemoveAddress(addr tcpip.Address) *tcpip.Error {
 	n.mu.Lock()
 	r := n.endpoints[NetworkEndpointID{addr}]
-	if r == nil || !r.holdsInsertRef {
+	if r == nil || r.kind != permanentEndpoint {
 		n.mu.Unlock()
 		return tcpip.ErrBadLocalAddress
 	}
 
-	r.holdsInsertRef = false
+	// Mark the endpoint as expired rather than dropping it outright: routes
+	// created before removal may still hold a reference to it, and it must
+	// keep rejecting new uses (incoming delivery, outgoing sends) until the
+	// last of those references goes away and removeEndpointLocked runs.
+	// 将端点标记为已过期而不是直接丢弃：移除前建立的路由可能仍持有其引用，
+	// 在最后一个引用释放、removeEndpointLocked真正执行之前，它必须持续
+	// 拒绝任何新的使用（收包、建立新路由）。
+	r.kind = permanentExpiredEndpoint
 	n.mu.Unlock()
 
 	r.decRef()
@@ -429,6 +605,14 @@ func (n *NIC) RemoveAddress(addr tcpip.Address) *tcpip.Error {
 // 当NIC从物理接口接收数据包时，将调用此函数。比如protocol是arp协议号， 那么会找到arp.HandlePacket来处理数据报。
 // protocol是ipv4协议号， 那么会找到ipv4.HandlePacket来处理数据报。
 func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr, localLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	n.mu.RLock()
+	bridgePort := n.bridgePort
+	n.mu.RUnlock()
+	if bridgePort != nil {
+		bridgePort.DeliverNetworkPacket(n, linkEP, remoteLinkAddr, localLinkAddr, protocol, vv)
+		return
+	}
+
 	log.Println("@step3 nic网卡解析以太网协议,分发到对应的 网络层 协议处理 ")
 	netProto, ok := n.stack.networkProtocols[protocol]
 	if !ok {
@@ -447,13 +631,31 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr, localLin
 
 	src, dst := netProto.ParseAddresses(vv.First())
 
+	// 如果该NIC启用了NUD邻居缓存（见setNUDConfigurations），收到的每一个包
+	// 都顺带证实了其来源地址当前仍然可达，此时直接更新记录，不用等一次专门
+	// 的单播探测。
+	// If this NIC opted into the NUD neighbor cache (see
+	// setNUDConfigurations), every received packet is itself evidence that
+	// its source address is currently reachable, so update the entry instead
+	// of waiting for a dedicated unicast probe.
+	n.mu.RLock()
+	neigh := n.neigh
+	n.mu.RUnlock()
+	if neigh != nil && len(remoteLinkAddr) != 0 {
+		neigh.handleConfirmation(src, remoteLinkAddr)
+	}
+
 	// 根据网络协议和数据包的目的地址，找到网络端
 	// 然后将数据包分发给网络层
 	if ref := n.getRef(protocol, dst); ref != nil {
 		r := makeRoute(protocol, dst, src, linkEP.LinkAddress(), ref)
 		r.RemoteLinkAddress = remoteLinkAddr
+		// HandlePacket trims vv's views in place, so the raw endpoints get a
+		// clone taken before it runs.
+		rawVV := vv.Clone(nil)
 		ref.ep.HandlePacket(&r, vv)
 		ref.decRef()
+		n.deliverRawPackets(protocol, rawVV)
 		return
 	}
 
@@ -461,77 +663,114 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr, localLin
 	// packet and forward it to the NIC.
 	//
 	// TODO: Should we be forwarding the packet even if promiscuous?
-	if n.stack.Forwarding() {
-		r, err := n.stack.FindRoute(0, "", dst, protocol)
-		if err != nil {
-			n.stack.stats.IP.InvalidAddressesReceived.Increment()
-			return
-		}
-		defer r.Release()
-
-		r.LocalLinkAddress = n.linkEP.LinkAddress()
-		r.RemoteLinkAddress = remoteLinkAddr
-
-		// Found a NIC.
-		n := r.ref.nic
-		n.mu.RLock()
-		ref, ok := n.endpoints[NetworkEndpointID{dst}]
-		n.mu.RUnlock()
-		if ok && ref.tryIncRef() {
-			ref.ep.HandlePacket(&r, vv)
-			ref.decRef()
-		} else {
-			// n doesn't have a destination endpoint.
-			// Send the packet out of n.
-			hdr := buffer.NewPrependableFromView(vv.First())
-			vv.RemoveFirst()
-			n.linkEP.WritePacket(&r, hdr, vv, protocol)
-		}
+	if n.stack.Forwarding() || n.Forwarding() {
+		n.forwardPacket(protocol, dst, remoteLinkAddr, vv)
 		return
 	}
 
 	n.stack.stats.IP.InvalidAddressesReceived.Increment()
 }
 
+// subnetMatchesLocked reports whether addr falls within one of n's
+// configured subnets. Callers must hold n.mu for reading or writing.
+// subnetMatchesLocked 判断addr是否落在n所配置的某个子网内，调用者必须已经
+// 持有n.mu的读锁或写锁。
+func (n *NIC) subnetMatchesLocked(addr tcpip.Address) bool {
+	for _, sn := range n.subnets {
+		if sn.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // 根据协议类型和目标地址，找出关联的Endpoint
 func (n *NIC) getRef(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address) *referencedNetworkEndpoint {
-	id := NetworkEndpointID{dst}
-
 	n.mu.RLock()
-	if ref, ok := n.endpoints[id]; ok && ref.tryIncRef() {
-		n.mu.RUnlock()
-		return ref
-	}
+	allowTemp := n.promiscuous || n.subnetMatchesLocked(dst)
+	n.mu.RUnlock()
 
-	promiscuous := n.promiscuous
-	// Check if the packet is for a subnet this NIC cares about.
-	if !promiscuous {
-		for _, sn := range n.subnets {
-			if sn.Contains(dst) {
-				promiscuous = true
-				break
+	// getRef is only ever used for inbound delivery, where "no endpoint" and
+	// "endpoint exists but is expired" are both just "this packet isn't for
+	// us"; only the outbound path (findEndpoint) needs to tell them apart.
+	// getRef只用于入站投递，"没有端点"和"端点存在但已过期"在这里都同样只是
+	// "这个包不是发给我们的"；只有出站路径（findEndpoint）才需要区分这两种
+	// 情况。
+	ref, _ := n.getRefOrCreateTemp(protocol, dst, CanBePrimaryEndpoint, allowTemp)
+	return ref
+}
+
+// getRefOrCreateTemp finds the endpoint, if any, with the given address. If
+// none exists and allowTemp is true, it creates a new "temporary" endpoint
+// that will only exist while there's a route through it. This is the shared
+// implementation behind findEndpoint (the spoofing/outbound path) and getRef
+// (the promiscuous/inbound path); they only differ in how allowTemp is
+// derived: findEndpoint uses n.spoofing, getRef uses n.promiscuous, and both
+// additionally allow it when addr falls within one of the NIC's configured
+// subnets. It returns ErrInvalidEndpointState when addr names an endpoint
+// that's expired (removed, but kept alive by a route's reference) and
+// allowTemp is false, so callers can tell that apart from addr simply not
+// existing.
+// getRefOrCreateTemp 根据地址查找网络端，如果不存在且allowTemp为true，则
+// 新建一个"临时"端点，该端点只在有路由引用它期间存活。这是findEndpoint（
+// 伪装/出站路径）和getRef（混杂模式/入站路径）共用的实现，二者的区别只在于
+// allowTemp的来源：findEndpoint看n.spoofing，getRef看n.promiscuous，并且
+// 只要addr落在该网卡配置的某个子网内，两者都允许创建临时端点。当addr对应的
+// 端点已过期（已被移除，但因路由引用而存活）且allowTemp为false时，返回
+// ErrInvalidEndpointState，以便调用方能把这种情况和addr根本不存在区分开。
+func (n *NIC) getRefOrCreateTemp(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, peb PrimaryEndpointBehavior, allowTemp bool) (*referencedNetworkEndpoint, *tcpip.Error) {
+	id := NetworkEndpointID{addr}
+
+	n.mu.RLock()
+	if ref, ok := n.endpoints[id]; ok {
+		// A permanentExpired endpoint can only be handed out when the
+		// caller is willing to fall back to temporary-endpoint behavior
+		// (promiscuous/spoofing/owned subnet); otherwise it must behave as
+		// an explicit error, not as if the address no longer existed.
+		// 已过期的端点只有在调用方愿意回退到临时端点行为时（混杂模式/地址
+		// 伪装/已拥有的子网）才能被返回，否则就应返回一个明确的错误，而不是
+		// 表现得像该地址根本不存在一样。
+		if ref.isValidForOutgoing() || allowTemp {
+			if ref.tryIncRef() {
+				n.mu.RUnlock()
+				return ref, nil
 			}
+		} else {
+			n.mu.RUnlock()
+			return nil, tcpip.ErrInvalidEndpointState
 		}
 	}
 	n.mu.RUnlock()
-	if promiscuous {
-		// Try again with the lock in exclusive mode. If we still can't
-		// get the endpoint, create a new "temporary" one. It will only
-		// exist while there's a route through it.
-		n.mu.Lock()
-		if ref, ok := n.endpoints[id]; ok && ref.tryIncRef() {
-			n.mu.Unlock()
-			return ref
-		}
-		ref, err := n.addAddressLocked(protocol, dst, CanBePrimaryEndpoint, true)
-		n.mu.Unlock()
-		if err == nil {
-			ref.holdsInsertRef = false
-			return ref
-		}
+
+	if !allowTemp {
+		return nil, nil
 	}
 
-	return nil
+	// Try again with the lock in exclusive mode. If we still can't get the
+	// endpoint, create a new "temporary" one. It will only exist while
+	// there's a route through it.
+	n.mu.Lock()
+	if ref, ok := n.endpoints[id]; ok && ref.tryIncRef() {
+		n.mu.Unlock()
+		return ref, nil
+	}
+	ref, err := n.addAddressLocked(protocol, addr, peb, true)
+	if err != nil {
+		n.mu.Unlock()
+		return nil, nil
+	}
+	// Must be set before unlocking: as soon as n.mu is released, ref is
+	// visible to concurrent readers under the lock (RemoveAddress, another
+	// getRefOrCreateTemp/getRef/findEndpoint, primaryEndpoint,
+	// getMainNICAddress), and addAddressLocked's struct literal otherwise
+	// leaves it defaulted to permanentEndpoint.
+	// 必须在解锁前设置：n.mu一旦释放，ref就对其他在锁下的并发读者可见
+	// （RemoveAddress、另一个getRefOrCreateTemp/getRef/findEndpoint、
+	// primaryEndpoint、getMainNICAddress），而addAddressLocked的结构体字面量
+	// 否则会让它保持默认值permanentEndpoint。
+	ref.kind = temporaryEndpoint
+	n.mu.Unlock()
+	return ref, nil
 }
 
 // DeliverTransportPacket delivers the packets to the appropriate transport
@@ -631,11 +870,22 @@ type referencedNetworkEndpoint struct {
 	// protocol. Set to nil otherwise.
 	linkCache LinkAddressCache
 
-	// holdsInsertRef is protected by the NIC's mutex. It indicates whether
-	// the reference count is biased by 1 due to the insertion of the
-	// endpoint. It is reset to false when RemoveAddress is called on the
-	// NIC.
-	holdsInsertRef bool
+	// kind is protected by the NIC's mutex. It describes the endpoint's
+	// place in its lifecycle, see endpointKind. It moves from
+	// permanentEndpoint to permanentExpiredEndpoint when RemoveAddress is
+	// called on the NIC, and starts out as temporaryEndpoint for endpoints
+	// created on demand for promiscuous mode/spoofing.
+	kind endpointKind
+}
+
+// isValidForOutgoing returns true if r can be used to send outgoing packets
+// and to back new routes. Expired permanent endpoints are kept alive by
+// routes that already reference them, but must not be handed out for new
+// uses.
+// isValidForOutgoing 判断该引用是否可以用于发送数据包或者新建路由，已过期的
+// permanent端点仍可能被旧路由引用着，但不能再被用于新的用途。
+func (r *referencedNetworkEndpoint) isValidForOutgoing() bool {
+	return r.kind != permanentExpiredEndpoint
 }
 
 // decRef decrements the ref count and cleans up the endpoint once it reaches
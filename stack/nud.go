@@ -0,0 +1,167 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/brewlin/net-protocol/tcpip"
+)
+
+// LinkAddressResolver is implemented by a network protocol (e.g. ARP, NDP)
+// capable of resolving a network address into a link address. A neighborCache
+// uses it to send out the solicitations driving its Incomplete/Probe states.
+// LinkAddressResolver由能够将网络地址解析为链路层地址的网络层协议（如ARP、
+// NDP）实现。neighborCache用它发送驱动其Incomplete/Probe状态的请求报文。
+type LinkAddressResolver interface {
+	// LinkAddressRequest sends a solicitation for addr's link address, using
+	// localAddr as the sender's address, out linkEP.
+	LinkAddressRequest(addr, localAddr tcpip.Address, linkEP LinkEndpoint) *tcpip.Error
+}
+
+// NeighborState is the state of a neighborCache entry, as defined by the
+// Neighbor Unreachability Detection state machine of RFC 4861 section 7.3.2.
+// NeighborState 表示一条邻居缓存记录在RFC 4861 NUD状态机中所处的状态。
+type NeighborState int
+
+const (
+	// Incomplete means address resolution is in progress and has not yet
+	// received a confirming reply.
+	Incomplete NeighborState = iota
+
+	// Reachable means positive confirmation was received within the last
+	// ReachableTime duration.
+	Reachable
+
+	// Stale means more than ReachableTime has elapsed since the last positive
+	// confirmation; the entry is still usable until a packet is sent through
+	// it.
+	Stale
+
+	// Delay means a packet was sent while in the Stale state, and the entry
+	// is waiting DelayFirstProbeTime for an upper-layer confirmation before
+	// probing.
+	Delay
+
+	// Probe means unicast probes are being sent to verify reachability.
+	Probe
+
+	// Static means the entry was added by hand and is never aged out.
+	Static
+
+	// Unreachable means address resolution failed.
+	Unreachable
+)
+
+// String implements fmt.Stringer.
+func (s NeighborState) String() string {
+	switch s {
+	case Incomplete:
+		return "Incomplete"
+	case Reachable:
+		return "Reachable"
+	case Stale:
+		return "Stale"
+	case Delay:
+		return "Delay"
+	case Probe:
+		return "Probe"
+	case Static:
+		return "Static"
+	case Unreachable:
+		return "Unreachable"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// NUDConfigurations is the set of configurable parameters controlling the
+// timing of the NUD state machine. Defaults mirror RFC 4861 section 10.
+// NUDConfigurations是控制NUD状态机时序的一组可配置参数，默认值取自RFC 4861
+// 第10节。
+type NUDConfigurations struct {
+	// BaseReachableTime is the base duration of the Reachable state. The
+	// duration actually applied to an entry is randomized into
+	// [MinRandomFactor, MaxRandomFactor] * BaseReachableTime so neighbors
+	// added at the same time don't all expire together.
+	BaseReachableTime time.Duration
+
+	// MinRandomFactor and MaxRandomFactor bound the randomization applied to
+	// BaseReachableTime.
+	MinRandomFactor float32
+	MaxRandomFactor float32
+
+	// RetransmitTimer is the time between retransmitted solicitations, both
+	// multicast (Incomplete) and unicast (Probe).
+	RetransmitTimer time.Duration
+
+	// DelayFirstProbeTime is how long a Stale entry waits, after the first
+	// packet is sent through it, for an upper-layer confirmation before
+	// moving to Probe.
+	DelayFirstProbeTime time.Duration
+
+	// MaxMulticastProbes is the number of multicast solicitations sent while
+	// Incomplete before the entry moves to Unreachable.
+	MaxMulticastProbes uint32
+
+	// MaxUnicastProbes is the number of unicast solicitations sent while
+	// Probe before the entry moves to Unreachable.
+	MaxUnicastProbes uint32
+
+	// UnreachableTime is how long an entry remains in the cache after moving
+	// to Unreachable before it is removed entirely.
+	UnreachableTime time.Duration
+}
+
+// DefaultNUDConfigurations returns the RFC 4861 recommended defaults.
+// DefaultNUDConfigurations 返回RFC 4861建议的默认NUD参数。
+func DefaultNUDConfigurations() NUDConfigurations {
+	return NUDConfigurations{
+		BaseReachableTime:   30 * time.Second,
+		MinRandomFactor:     0.5,
+		MaxRandomFactor:     1.5,
+		RetransmitTimer:     time.Second,
+		DelayFirstProbeTime: 5 * time.Second,
+		MaxMulticastProbes:  3,
+		MaxUnicastProbes:    3,
+		UnreachableTime:     3 * time.Second,
+	}
+}
+
+// reachableTime returns BaseReachableTime randomized by
+// [MinRandomFactor, MaxRandomFactor], per RFC 4861 section 6.3.2.
+func (c *NUDConfigurations) reachableTime() time.Duration {
+	min, max := c.MinRandomFactor, c.MaxRandomFactor
+	if min <= 0 {
+		min = 1
+	}
+	if max <= min {
+		max = min
+	}
+	factor := min + rand.Float32()*(max-min)
+	return time.Duration(float32(c.BaseReachableTime) * factor)
+}
+
+// NeighborStats holds counters tracking the behavior of the NUD-based
+// neighborCache of the stack's NICs. The legacy linkAddrCache does not
+// update them.
+// NeighborStats记录了协议栈中各NIC上启用NUD的neighborCache相关的统计计数。
+// 旧版的linkAddrCache不会更新这些计数。
+type NeighborStats struct {
+	// UnreachableEntryLookups counts lookups resolved against an entry that
+	// was in the Unreachable state.
+	UnreachableEntryLookups *tcpip.StatCounter
+}
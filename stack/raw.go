@@ -0,0 +1,197 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"github.com/brewlin/net-protocol/tcpip"
+	"github.com/brewlin/net-protocol/tcpip/buffer"
+	"github.com/brewlin/net-protocol/tcpip/header"
+)
+
+// RawEndpoint is implemented by raw (SOCK_RAW) endpoints, normally the ones
+// created by the raw package. A NIC hands every raw endpoint associated with
+// it a copy of each network-layer packet matching its protocol pair; the
+// endpoint never gets a say in whether delivery to the normal network
+// endpoint happens.
+// RawEndpoint由raw（SOCK_RAW）端点实现，通常是raw包创建的那些端点。NIC会将
+// 每一个匹配协议组合的网络层数据包副本交给所有关联的raw端点；raw端点本身不
+// 会影响数据包是否正常分发给网络层端。
+type RawEndpoint interface {
+	// HandlePacket delivers a copy of a received network-layer packet that
+	// matched this endpoint's protocol pair.
+	HandlePacket(vv buffer.VectorisedView)
+
+	// TransportProtocol is the transport protocol number this endpoint
+	// wants packets for, or 0 for the "any transport protocol" wildcard
+	// bucket.
+	TransportProtocol() tcpip.TransportProtocolNumber
+}
+
+// RawStats holds counters tracking delivery of packets to a NIC's raw
+// (SOCK_RAW) endpoints.
+// RawStats记录了向NIC的raw（SOCK_RAW）端点投递数据包相关的统计计数。
+type RawStats struct {
+	// PacketsDelivered counts each (endpoint, packet) delivery, i.e. a
+	// packet matching two associated endpoints counts twice.
+	PacketsDelivered *tcpip.StatCounter
+
+	// PacketsDropped counts packets that matched no associated raw endpoint
+	// (specific or wildcard) and so were never delivered.
+	PacketsDropped *tcpip.StatCounter
+}
+
+// rawEndpointKey identifies one of a NIC's per-protocol-pair raw endpoint
+// buckets. transProto 0 is the wildcard bucket matched in addition to (not
+// instead of) an endpoint's specific bucket.
+type rawEndpointKey struct {
+	netProto   tcpip.NetworkProtocolNumber
+	transProto tcpip.TransportProtocolNumber
+}
+
+// AssociateRawEndpoint registers ep on n, so it starts receiving a copy of
+// every future network-layer packet matching netProto and ep's transport
+// protocol (or every packet for netProto, regardless of transport, if ep's
+// transport protocol is the 0 wildcard).
+// AssociateRawEndpoint在n上注册ep，使其开始接收每一个匹配netProto与ep的
+// 传输层协议的未来网络层数据包副本（若ep的传输层协议为通配符0，则接收
+// netProto下的所有数据包，无论传输层协议是什么）。
+func (n *NIC) AssociateRawEndpoint(netProto tcpip.NetworkProtocolNumber, ep RawEndpoint) {
+	key := rawEndpointKey{netProto, ep.TransportProtocol()}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.rawEndpoints == nil {
+		n.rawEndpoints = make(map[rawEndpointKey][]RawEndpoint)
+	}
+	n.rawEndpoints[key] = append(n.rawEndpoints[key], ep)
+}
+
+// DisassociateRawEndpoint reverses a prior AssociateRawEndpoint.
+// DisassociateRawEndpoint撤销之前的AssociateRawEndpoint注册。
+func (n *NIC) DisassociateRawEndpoint(netProto tcpip.NetworkProtocolNumber, ep RawEndpoint) {
+	key := rawEndpointKey{netProto, ep.TransportProtocol()}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	eps := n.rawEndpoints[key]
+	for i, e := range eps {
+		if e == ep {
+			n.rawEndpoints[key] = append(eps[:i], eps[i+1:]...)
+			return
+		}
+	}
+}
+
+// deliverRawPackets fans a copy of vv out to every raw endpoint associated
+// with n that matches netProto/transProto, plus the transProto-agnostic
+// wildcard bucket. It's called from DeliverNetworkPacket after the packet
+// has already been handed to the normal network endpoint, so a raw endpoint
+// never sees a packet the stack itself rejected outright.
+// deliverRawPackets把vv的副本分发给n上所有匹配netProto/transProto的raw
+// 端点，以及不关心传输层协议的通配符桶。它在DeliverNetworkPacket把数据包
+// 交给正常的网络层端之后才被调用，因此raw端点永远不会看到被协议栈直接拒绝
+// 的数据包。
+func (n *NIC) deliverRawPackets(netProto tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	transProto, ok := rawTransportProtocolOf(netProto, vv.First())
+	if !ok {
+		return
+	}
+
+	n.mu.RLock()
+	specific := n.rawEndpoints[rawEndpointKey{netProto, transProto}]
+	wildcard := n.rawEndpoints[rawEndpointKey{netProto, 0}]
+	n.mu.RUnlock()
+
+	if len(specific) == 0 && len(wildcard) == 0 {
+		n.stack.stats.Raw.PacketsDropped.Increment()
+		return
+	}
+
+	// Each endpoint gets its own Clone of vv's view list, so none of them
+	// can observe another's RemoveFirst/TrimFront calls.
+	for _, ep := range specific {
+		ep.HandlePacket(vv.Clone(nil))
+		n.stack.stats.Raw.PacketsDelivered.Increment()
+	}
+	for _, ep := range wildcard {
+		ep.HandlePacket(vv.Clone(nil))
+		n.stack.stats.Raw.PacketsDelivered.Increment()
+	}
+}
+
+// rawTransportProtocolOf extracts the L4 protocol number embedded in an IP
+// header so raw packets can be matched against a (netProto, transProto)
+// bucket without fully parsing the transport header. It only understands
+// IPv4 and IPv6; for any other network protocol there's no well-defined
+// notion of a raw socket, so ok is false.
+func rawTransportProtocolOf(netProto tcpip.NetworkProtocolNumber, hdr buffer.View) (tcpip.TransportProtocolNumber, bool) {
+	switch netProto {
+	case header.IPv4ProtocolNumber:
+		if len(hdr) < header.IPv4MinimumSize {
+			return 0, false
+		}
+		return tcpip.TransportProtocolNumber(header.IPv4(hdr).Protocol()), true
+	case header.IPv6ProtocolNumber:
+		if len(hdr) < header.IPv6MinimumSize {
+			return 0, false
+		}
+		return tcpip.TransportProtocolNumber(header.IPv6(hdr).NextHeader()), true
+	default:
+		return 0, false
+	}
+}
+
+// WriteRawPacket validates a fully-formed IP datagram handed in by an
+// IPPROTO_RAW raw endpoint and sends it essentially as-is: it bypasses
+// network-layer header construction entirely, picking the outbound NIC via
+// the stack's routing table (keyed off the destination address already
+// present in hdr) rather than necessarily n itself, and handing the buffer
+// directly to that NIC's link endpoint.
+// WriteRawPacket校验一个由IPPROTO_RAW raw端点传入的、已经构造完整的IP数据
+// 报，并几乎原样发送：它完全绕过网络层头部的构造，通过协议栈的路由表（以
+// hdr中已有的目的地址为key）挑选出站网卡——不一定是n自身——然后把缓冲区
+// 直接交给该网卡的链路层端。
+func (n *NIC) WriteRawPacket(protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) *tcpip.Error {
+	hdr := vv.First()
+	if protocol != header.IPv4ProtocolNumber && protocol != header.IPv6ProtocolNumber {
+		return tcpip.ErrUnknownProtocol
+	}
+
+	var dst tcpip.Address
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if len(hdr) < header.IPv4MinimumSize {
+			return tcpip.ErrInvalidOptionValue
+		}
+		dst = header.IPv4(hdr).DestinationAddress()
+	case header.IPv6ProtocolNumber:
+		if len(hdr) < header.IPv6MinimumSize {
+			return tcpip.ErrInvalidOptionValue
+		}
+		dst = header.IPv6(hdr).DestinationAddress()
+	}
+
+	r, err := n.stack.FindRoute(0, "", dst, protocol)
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+
+	outNIC := r.ref.nic
+	if writeErr := outNIC.linkEP.WritePacket(&r, buffer.NewPrependable(0), vv, protocol); writeErr != nil {
+		return writeErr
+	}
+	return nil
+}